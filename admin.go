@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/mailgun/groupcache/v2"
+)
+
+// metricsRecorder tracks the things groupcache's own Stats don't: upstream
+// fetch latency. Everything else reported by /metrics is read straight off
+// the groupcache.Group at scrape time.
+type metricsRecorder struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	total   uint64
+}
+
+func newMetricsRecorder() *metricsRecorder {
+	buckets := []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	return &metricsRecorder{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1), // +1 for the +Inf bucket
+	}
+}
+
+// ObserveFetchDuration records how long a single upstream fetch took.
+func (m *metricsRecorder) ObserveFetchDuration(seconds float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sum += seconds
+	m.total++
+	for i, le := range m.buckets {
+		if seconds <= le {
+			m.counts[i]++
+		}
+	}
+	m.counts[len(m.buckets)]++
+}
+
+func (m *metricsRecorder) snapshot() (buckets []float64, counts []uint64, sum float64, total uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]float64(nil), m.buckets...), append([]uint64(nil), m.counts...), m.sum, m.total
+}
+
+// newAdminMux builds the admin HTTP mux: /stats, /healthz and /metrics.
+// It's served on its own bind address (--admin_bind) so it can be kept off
+// the public internet independently of the proxy and cache ports.
+func newAdminMux(group *groupcache.Group, metrics *metricsRecorder) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		out := struct {
+			Gets          int64                 `json:"gets"`
+			CacheHits     int64                 `json:"cache_hits"`
+			PeerLoads     int64                 `json:"peer_loads"`
+			PeerErrors    int64                 `json:"peer_errors"`
+			Loads         int64                 `json:"loads"`
+			LoadsDeduped  int64                 `json:"loads_deduped"`
+			LocalLoads    int64                 `json:"local_loads"`
+			LocalLoadErrs int64                 `json:"local_load_errs"`
+			MainCache     groupcache.CacheStats `json:"main_cache"`
+			HotCache      groupcache.CacheStats `json:"hot_cache"`
+		}{
+			Gets:          group.Stats.Gets.Get(),
+			CacheHits:     group.Stats.CacheHits.Get(),
+			PeerLoads:     group.Stats.PeerLoads.Get(),
+			PeerErrors:    group.Stats.PeerErrors.Get(),
+			Loads:         group.Stats.Loads.Get(),
+			LoadsDeduped:  group.Stats.LoadsDeduped.Get(),
+			LocalLoads:    group.Stats.LocalLoads.Get(),
+			LocalLoadErrs: group.Stats.LocalLoadErrs.Get(),
+			MainCache:     group.CacheStats(groupcache.MainCache),
+			HotCache:      group.CacheStats(groupcache.HotCache),
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	})
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, group, metrics)
+	})
+
+	return mux
+}
+
+func writeMetrics(w http.ResponseWriter, group *groupcache.Group, metrics *metricsRecorder) {
+	main := group.CacheStats(groupcache.MainCache)
+	hot := group.CacheStats(groupcache.HotCache)
+
+	fmt.Fprintln(w, "# HELP ritratt_cache_gets_total Total number of Get requests, including from peers.")
+	fmt.Fprintln(w, "# TYPE ritratt_cache_gets_total counter")
+	fmt.Fprintf(w, "ritratt_cache_gets_total %d\n", group.Stats.Gets.Get())
+
+	fmt.Fprintln(w, "# HELP ritratt_cache_hits_total Total number of cache hits.")
+	fmt.Fprintln(w, "# TYPE ritratt_cache_hits_total counter")
+	fmt.Fprintf(w, "ritratt_cache_hits_total %d\n", group.Stats.CacheHits.Get())
+
+	fmt.Fprintln(w, "# HELP ritratt_peer_loads_total Total number of loads satisfied by a peer.")
+	fmt.Fprintln(w, "# TYPE ritratt_peer_loads_total counter")
+	fmt.Fprintf(w, "ritratt_peer_loads_total %d\n", group.Stats.PeerLoads.Get())
+
+	fmt.Fprintln(w, "# HELP ritratt_peer_errors_total Total number of errored peer loads.")
+	fmt.Fprintln(w, "# TYPE ritratt_peer_errors_total counter")
+	fmt.Fprintf(w, "ritratt_peer_errors_total %d\n", group.Stats.PeerErrors.Get())
+
+	fmt.Fprintln(w, "# HELP ritratt_cache_evictions_total Total number of cache evictions.")
+	fmt.Fprintln(w, "# TYPE ritratt_cache_evictions_total counter")
+	fmt.Fprintf(w, "ritratt_cache_evictions_total{cache=\"main\"} %d\n", main.Evictions)
+	fmt.Fprintf(w, "ritratt_cache_evictions_total{cache=\"hot\"} %d\n", hot.Evictions)
+
+	buckets, counts, sum, total := metrics.snapshot()
+	fmt.Fprintln(w, "# HELP ritratt_upstream_fetch_duration_seconds Latency of upstream image fetches.")
+	fmt.Fprintln(w, "# TYPE ritratt_upstream_fetch_duration_seconds histogram")
+	for i, le := range buckets {
+		fmt.Fprintf(w, "ritratt_upstream_fetch_duration_seconds_bucket{le=\"%g\"} %d\n", le, counts[i])
+	}
+	fmt.Fprintf(w, "ritratt_upstream_fetch_duration_seconds_bucket{le=\"+Inf\"} %d\n", counts[len(buckets)])
+	fmt.Fprintf(w, "ritratt_upstream_fetch_duration_seconds_sum %g\n", sum)
+	fmt.Fprintf(w, "ritratt_upstream_fetch_duration_seconds_count %d\n", total)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/groupcache/v2"
+)
+
+// statusInvalidContentType marks a negatively-cached entry for an origin
+// response that wasn't a decodable, non-SVG image; it isn't a real HTTP
+// status so it can't collide with one.
+const statusInvalidContentType = -1
+
+// cacheEnvelope is what's actually stored as a groupcache value: the image
+// bytes plus enough metadata to decide when the entry goes stale and to
+// revalidate it cheaply instead of blindly refetching, since groupcache
+// itself has no notion of expiry.
+type cacheEnvelope struct {
+	FetchedAt    time.Time
+	ETag         string
+	LastModified string
+	Status       int
+	ContentType  string
+	Body         []byte
+	MaxAge       time.Duration
+	Expires      time.Time
+}
+
+// ttl returns how long this envelope should be considered fresh: the
+// origin's Cache-Control max-age or Expires header if present, otherwise
+// positiveTTL for a successful fetch or negativeTTL for a negatively-cached
+// one (a 404 or an invalid/undecodable image). A max-age of 0, or an
+// Expires at or before FetchedAt, counts as absent and gives positiveTTL.
+func (e *cacheEnvelope) ttl(positiveTTL, negativeTTL time.Duration) time.Duration {
+	if e.Status != http.StatusOK {
+		return negativeTTL
+	}
+	if e.MaxAge > 0 {
+		return e.MaxAge
+	}
+	if !e.Expires.IsZero() {
+		if d := e.Expires.Sub(e.FetchedAt); d > 0 {
+			return d
+		}
+	}
+	return positiveTTL
+}
+
+func (e *cacheEnvelope) expired(positiveTTL, negativeTTL time.Duration) bool {
+	return time.Since(e.FetchedAt) > e.ttl(positiveTTL, negativeTTL)
+}
+
+func encodeEnvelope(env *cacheEnvelope) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(env); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeEnvelope(raw []byte) (*cacheEnvelope, error) {
+	var env cacheEnvelope
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&env); err != nil {
+		return nil, err
+	}
+	return &env, nil
+}
+
+// parseMaxAge extracts max-age from a Cache-Control header value.
+func parseMaxAge(header string) (time.Duration, bool) {
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if !strings.HasPrefix(part, "max-age=") {
+			continue
+		}
+		secs, err := strconv.Atoi(strings.TrimPrefix(part, "max-age="))
+		if err != nil || secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	return 0, false
+}
+
+// Freshness tracks the last envelope seen for each cache key, purely so the
+// Getter can make a conditional request instead of a blind one when a key
+// is re-fetched, and so the proxy handler knows when a key needs
+// re-fetching at all. It is process-local, and the Getter only runs on a
+// key's owning peer, so on a multi-peer cluster only the owner ever
+// populates or consults it: non-owner peers always see Stale return false
+// for keys they don't own, so they never issue the group.Remove that would
+// evict the owner's copy. In short, TTL-based revalidation
+// as implemented here only works correctly when cache_peers names a single
+// node; distributing it properly would mean moving this metadata into the
+// cached envelope itself so the owner is always the one deciding expiry.
+// This isn't just a code comment: the Watcher logs a startup/operator-facing
+// warning (see peers.go's apply) whenever more than one peer is configured,
+// so the restriction is visible without reading this file.
+type Freshness struct {
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*cacheEnvelope
+}
+
+// NewFreshness creates a Freshness tracker using positiveTTL for successful
+// fetches and negativeTTL for negatively-cached ones.
+func NewFreshness(positiveTTL, negativeTTL time.Duration) *Freshness {
+	return &Freshness{
+		positiveTTL: positiveTTL,
+		negativeTTL: negativeTTL,
+		entries:     make(map[string]*cacheEnvelope),
+	}
+}
+
+// Lookup returns the last known envelope for key, or nil if none is known.
+func (f *Freshness) Lookup(key string) *cacheEnvelope {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.entries[key]
+}
+
+// Store records env as the last known envelope for key.
+func (f *Freshness) Store(key string, env *cacheEnvelope) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries[key] = env
+}
+
+// Stale reports whether key's last known envelope has passed its TTL. An
+// unknown key is never stale - there's nothing to revalidate yet, so the
+// normal groupcache miss path handles the first fetch.
+func (f *Freshness) Stale(key string) bool {
+	env := f.Lookup(key)
+	return env != nil && env.expired(f.positiveTTL, f.negativeTTL)
+}
+
+// fetchImage resolves spec+url to a cacheEnvelope through group, forcing a
+// revalidation (via group.Remove, which causes the next Get to invoke the
+// Getter again) whenever Freshness considers the cached entry stale.
+func fetchImage(ctx context.Context, group *groupcache.Group, freshness *Freshness, spec transformSpec, url string) (*cacheEnvelope, error) {
+	key := buildCacheKey(spec, url)
+
+	if freshness.Stale(key) {
+		if err := group.Remove(ctx, key); err != nil {
+			log.Printf("[cache] Error evicting stale entry for %s: %s", key, err)
+		}
+	}
+
+	var raw []byte
+	if err := group.Get(ctx, key, groupcache.ByteSliceSink(&raw)); err != nil {
+		return nil, err
+	}
+
+	return decodeEnvelope(raw)
+}
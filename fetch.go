@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var privateCIDRs = mustParseCIDRs(
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"169.254.0.0/16",
+	"::1/128",
+	"fe80::/10",
+	"fc00::/7",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+func isPrivateIP(ip net.IP) bool {
+	for _, n := range privateCIDRs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPublicHost resolves host (a hostname or a literal IP) and rejects it
+// if any of its addresses fall into an RFC1918, loopback or link-local
+// range, guarding against SSRF via images hosted on internal services.
+func checkPublicHost(host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		if isPrivateIP(ip) {
+			return fmt.Errorf("fetch: refusing to connect to private address %s", ip)
+		}
+		return nil
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if isPrivateIP(ip) {
+			return fmt.Errorf("fetch: refusing to connect to %s, which resolves to private address %s", host, ip)
+		}
+	}
+
+	return nil
+}
+
+// newUpstreamClient builds the http.Client used to fetch origin images: a
+// bounded timeout, a capped number of redirects, and, unless
+// allowPrivateTargets is set, an SSRF guard applied both to the dial target
+// and to every redirect hop.
+func newUpstreamClient(timeout time.Duration, allowPrivateTargets bool) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if !allowPrivateTargets {
+				host, _, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				if err := checkPublicHost(host); err != nil {
+					return nil, err
+				}
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("fetch: stopped after 5 redirects")
+			}
+			if !allowPrivateTargets {
+				return checkPublicHost(req.URL.Hostname())
+			}
+			return nil
+		},
+	}
+}
+
+// fetchUpstream fetches url (trying https, then falling back to http) and
+// returns it as a cacheEnvelope. If prior is non-nil, the request is made
+// conditional on prior's ETag/Last-Modified, so an unchanged origin costs a
+// 304 rather than a full re-download; prior.Body is reused in that case.
+// Transport failures (network, timeout, SSRF guard), any other unexpected
+// status and a body over maxBytes are returned as an error - a 404 or an
+// origin serving something that isn't a decodable, non-SVG image comes back
+// as a negatively-cacheable envelope instead, so the caller can give it its
+// own (short) TTL.
+func fetchUpstream(ctx context.Context, client *http.Client, maxBytes int64, url string, prior *cacheEnvelope) (*cacheEnvelope, error) {
+	resp, err := doFetch(ctx, client, "https://"+url, prior)
+	if err != nil {
+		log.Printf("[https] Error while querying %s: %s", url, err)
+
+		resp, err = doFetch(ctx, client, "http://"+url, prior)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer resp.Body.Close()
+
+	now := time.Now()
+
+	if resp.StatusCode == http.StatusNotModified && prior != nil {
+		touched := *prior
+		touched.FetchedAt = now
+		return &touched, nil
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return &cacheEnvelope{FetchedAt: now, Status: http.StatusNotFound}, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch: unexpected status %d for %s", resp.StatusCode, url)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxBytes {
+		return nil, fmt.Errorf("fetch: %s exceeded max_image_bytes (%d)", url, maxBytes)
+	}
+
+	// Never trust the origin's Content-Type header: sniff the real bytes,
+	// and reject SVGs unambiguously regardless of how they're labeled. See
+	// https://www.owasp.org/images/0/03/Mario_Heiderich_OWASP_Sweden_The_image_that_called_me.pdf
+	//
+	// Both of these are negatively cached rather than returned as an error,
+	// so a misconfigured origin doesn't get hammered on every request.
+	if looksLikeSVG(body) {
+		return &cacheEnvelope{FetchedAt: now, Status: statusInvalidContentType}, nil
+	}
+	sniffed := http.DetectContentType(body)
+	if !strings.HasPrefix(sniffed, "image/") {
+		return &cacheEnvelope{FetchedAt: now, Status: statusInvalidContentType}, nil
+	}
+
+	// image.DecodeConfig is stricter still: it confirms the bytes actually
+	// parse as one of the registered image codecs before we cache them
+	_, format, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		return &cacheEnvelope{FetchedAt: now, Status: statusInvalidContentType}, nil
+	}
+
+	env := &cacheEnvelope{
+		FetchedAt:    now,
+		Status:       http.StatusOK,
+		ContentType:  "image/" + format,
+		Body:         body,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	if maxAge, ok := parseMaxAge(resp.Header.Get("Cache-Control")); ok {
+		env.MaxAge = maxAge
+	} else if expires := resp.Header.Get("Expires"); expires != "" {
+		if t, err := http.ParseTime(expires); err == nil {
+			env.Expires = t
+		}
+	}
+
+	return env, nil
+}
+
+func doFetch(ctx context.Context, client *http.Client, url string, prior *cacheEnvelope) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if prior != nil {
+		if prior.ETag != "" {
+			req.Header.Set("If-None-Match", prior.ETag)
+		}
+		if prior.LastModified != "" {
+			req.Header.Set("If-Modified-Since", prior.LastModified)
+		}
+	}
+	return client.Do(req.WithContext(ctx))
+}
+
+func looksLikeSVG(body []byte) bool {
+	head := body
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	return bytes.Contains(bytes.ToLower(head), []byte("<svg"))
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/mailgun/groupcache/v2"
+	"github.com/mailgun/groupcache/v2/consistenthash"
+	pb "github.com/mailgun/groupcache/v2/groupcachepb"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+
+	"github.com/lavab/ritratt/ritrattpb"
+)
+
+// GRPCPool is a groupcache PeerPicker that fetches from peers over gRPC
+// instead of groupcache's built-in HTTP transport, using the ritrattpb.Peer
+// service defined alongside it.
+type GRPCPool struct {
+	self     string
+	replicas int
+	dialOpts []grpc.DialOption
+
+	mu      sync.Mutex
+	peers   *consistenthash.Map
+	getters map[string]*grpcGetter
+	conns   map[string]*grpc.ClientConn
+}
+
+// NewGRPCPool creates a GRPCPool whose own address is self, and registers it
+// as groupcache's PeerPicker. self must be reachable by peers as a gRPC
+// target, e.g. "10.0.0.1:5002". replicas sets the number of virtual nodes
+// per peer in the pool's consistent hash ring, matching groupcache's own
+// HTTPPoolOptions.Replicas so routing stays consistent across transports.
+// dialOpts is passed to grpc.Dial for every peer connection, so callers
+// control transport security (grpc.WithTransportCredentials(...)) instead of
+// the pool hardcoding plaintext.
+func NewGRPCPool(self string, replicas int, dialOpts ...grpc.DialOption) *GRPCPool {
+	p := &GRPCPool{
+		self:     self,
+		replicas: replicas,
+		dialOpts: dialOpts,
+		getters:  make(map[string]*grpcGetter),
+		conns:    make(map[string]*grpc.ClientConn),
+	}
+	groupcache.RegisterPeerPicker(func() groupcache.PeerPicker { return p })
+	return p
+}
+
+// Set updates the pool's list of peers, dialing any new ones and tearing
+// down connections to peers that are no longer present. Each call replaces
+// the previous peer set.
+func (p *GRPCPool) Set(peers ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.peers = consistenthash.New(p.replicas, nil)
+	p.peers.Add(peers...)
+
+	getters := make(map[string]*grpcGetter, len(peers))
+	conns := make(map[string]*grpc.ClientConn, len(peers))
+	for _, peer := range peers {
+		if peer == p.self {
+			continue
+		}
+
+		conn, ok := p.conns[peer]
+		if !ok {
+			var err error
+			conn, err = grpc.Dial(peer, p.dialOpts...)
+			if err != nil {
+				log.Printf("[grpcpool] Error dialing peer %s: %s", peer, err)
+				continue
+			}
+		}
+		conns[peer] = conn
+		getters[peer] = &grpcGetter{addr: peer, client: ritrattpb.NewPeerClient(conn)}
+	}
+
+	// Close connections to peers that dropped out of the set - otherwise
+	// every membership change leaks a conn and its read/write goroutines.
+	for peer, conn := range p.conns {
+		if _, ok := conns[peer]; !ok {
+			if err := conn.Close(); err != nil {
+				log.Printf("[grpcpool] Error closing connection to %s: %s", peer, err)
+			}
+		}
+	}
+
+	p.conns = conns
+	p.getters = getters
+}
+
+// PickPeer implements groupcache.PeerPicker.
+func (p *GRPCPool) PickPeer(key string) (groupcache.ProtoGetter, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.peers == nil || p.peers.IsEmpty() {
+		return nil, false
+	}
+	if peer := p.peers.Get(key); peer != p.self {
+		if getter, ok := p.getters[peer]; ok {
+			return getter, true
+		}
+	}
+	return nil, false
+}
+
+// grpcGetter implements groupcache.ProtoGetter by calling Retrieve/Remove on
+// a single peer's ritrattpb.Peer service.
+type grpcGetter struct {
+	addr   string
+	client ritrattpb.PeerClient
+}
+
+func (g *grpcGetter) Get(ctx context.Context, in *pb.GetRequest, out *pb.GetResponse) error {
+	resp, err := g.client.Retrieve(ctx, &ritrattpb.RetrieveRequest{
+		Group: in.GetGroup(),
+		Key:   in.GetKey(),
+	})
+	if err != nil {
+		return err
+	}
+
+	out.Value = resp.Value
+	out.MinuteQps = proto.Float64(resp.MinuteQps)
+
+	return nil
+}
+
+// Remove forwards a cache eviction to the peer, mirroring what Get does for
+// lookups, so a group.Remove issued on a peer that doesn't own the key
+// also evicts the owner's copy.
+func (g *grpcGetter) Remove(ctx context.Context, in *pb.GetRequest) error {
+	_, err := g.client.Remove(ctx, &ritrattpb.RemoveRequest{
+		Group: in.GetGroup(),
+		Key:   in.GetKey(),
+	})
+	return err
+}
+
+// GetURL implements groupcache.ProtoGetter.
+func (g *grpcGetter) GetURL() string {
+	return g.addr
+}
+
+// grpcPeerServer implements ritrattpb.PeerServer by serving Retrieve
+// requests out of the local groupcache groups, the gRPC-side counterpart of
+// what groupcache's HTTPPool does for HTTP peers.
+type grpcPeerServer struct{}
+
+func (grpcPeerServer) Retrieve(ctx context.Context, req *ritrattpb.RetrieveRequest) (*ritrattpb.RetrieveResponse, error) {
+	group := groupcache.GetGroup(req.Group)
+	if group == nil {
+		return nil, fmt.Errorf("grpcpool: no such group %q", req.Group)
+	}
+
+	var value []byte
+	if err := group.Get(ctx, req.Key, groupcache.AllocatingByteSliceSink(&value)); err != nil {
+		return nil, err
+	}
+
+	return &ritrattpb.RetrieveResponse{Value: value}, nil
+}
+
+func (grpcPeerServer) Remove(ctx context.Context, req *ritrattpb.RemoveRequest) (*ritrattpb.RemoveResponse, error) {
+	group := groupcache.GetGroup(req.Group)
+	if group == nil {
+		return nil, fmt.Errorf("grpcpool: no such group %q", req.Group)
+	}
+
+	if err := group.Remove(ctx, req.Key); err != nil {
+		return nil, err
+	}
+
+	return &ritrattpb.RemoveResponse{}, nil
+}
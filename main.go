@@ -1,14 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
-	"io/ioutil"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"strings"
+	"time"
 
-	"github.com/golang/groupcache"
+	"github.com/mailgun/groupcache/v2"
 	"github.com/namsral/flag"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/lavab/ritratt/ritrattpb"
 )
 
 var (
@@ -19,11 +27,34 @@ var (
 	logForceColors = flag.Bool("log_force_colors", false, "Force colored prompt?")
 	// Proxy server settings
 	proxyBind = flag.String("proxy_bind", ":5000", "Bind address of the proxy server")
+	// Admin server settings
+	adminBind = flag.String("admin_bind", ":5003", "Bind address of the admin server (/stats, /healthz, /metrics)")
+	// Upstream fetch settings
+	fetchTimeout        = flag.String("fetch_timeout", "10s", "Timeout for upstream image fetches")
+	maxImageBytes       = flag.Int64("max_image_bytes", 10<<20, "Maximum number of bytes to read from an upstream image")
+	allowPrivateTargets = flag.Bool("allow_private_targets", false, "Allow fetching images from RFC1918/loopback/link-local addresses")
+	cacheTTL            = flag.String("cache_ttl", "5m", "How long a successfully fetched image is cached before revalidation, unless overridden by the origin's Cache-Control/Expires")
+	cacheNegativeTTL    = flag.String("cache_negative_ttl", "30s", "How long a 404 or invalid-content-type result is cached before it's retried")
 	// Groupcache settings
 	cacheBind   = flag.String("cache_bind", ":5001", "Bind address of the groupcache server")
 	cachePublic = flag.String("cache_public", "", "Public address of the groupcache server")
 	cachePeers  = flag.String("cache_peers", "", "List of peers in the groupcache cluster")
 	cacheSize   = flag.Int64("cache_size", 64<<20, "Size of the LRU cache")
+	// Peer transport settings
+	cacheTransport = flag.String("cache_transport", "http", "Transport used for peer-to-peer fetches: http or grpc")
+	cacheGRPCBind  = flag.String("cache_grpc_bind", ":5002", "Bind address of the gRPC peer server (cache_transport=grpc)")
+	cacheGRPCTLS   = flag.Bool("cache_grpc_tls", false, "Use TLS (via the system cert pool) for gRPC peer connections instead of plaintext (cache_transport=grpc)")
+	// Peer discovery settings
+	cachePeerDiscovery  = flag.String("cache_peer_discovery", "static", "Peer discovery backend: static, dns, consul, or file")
+	cacheHashReplicas   = flag.Int("cache_hash_replicas", 50, "Number of virtual nodes per peer in the consistent hash ring")
+	cachePeerPoll       = flag.String("cache_peer_poll", "5s", "How often to poll the peer discovery backend for membership changes")
+	cachePeerDebounce   = flag.String("cache_peer_debounce", "2s", "How long a new peer set must be stable before it's applied")
+	cachePeerDNSService = flag.String("cache_peer_dns_service", "groupcache", "SRV service name to look up (cache_peer_discovery=dns)")
+	cachePeerDNSProto   = flag.String("cache_peer_dns_proto", "tcp", "SRV protocol to look up (cache_peer_discovery=dns)")
+	cachePeerDNSName    = flag.String("cache_peer_dns_name", "", "SRV domain name to look up (cache_peer_discovery=dns)")
+	cachePeerConsulAddr = flag.String("cache_peer_consul_addr", "http://127.0.0.1:8500", "Consul HTTP API address (cache_peer_discovery=consul)")
+	cachePeerConsulName = flag.String("cache_peer_consul_service", "ritratt", "Consul service name to watch (cache_peer_discovery=consul)")
+	cachePeerFile       = flag.String("cache_peer_file", "", "Path to a newline-separated peer list (cache_peer_discovery=file)")
 )
 
 var (
@@ -34,103 +65,212 @@ func main() {
 	// Parse the flags
 	flag.Parse()
 
-	// Create a new groupcache pool
-	pool := groupcache.NewHTTPPool(*cachePublic)
-	pool.Set(strings.Split(*cachePeers, ",")...)
+	// Wire up the peer transport: either groupcache's built-in HTTP pool, or
+	// our own gRPC-based PeerPicker
+	var peerSetter PeerSetter
+	switch *cacheTransport {
+	case "http":
+		pool := groupcache.NewHTTPPoolOpts(*cachePublic, &groupcache.HTTPPoolOptions{
+			Replicas: *cacheHashReplicas,
+		})
+		pool.Set(strings.Split(*cachePeers, ",")...)
+		peerSetter = pool
 
-	// Listen and serve the groupcache pool
-	cacheServer := http.Server{
-		Addr:    *cacheBind,
-		Handler: pool,
-	}
-	go func() {
-		log.Printf("Starting up the cache HTTP server on address %s", *cacheBind)
+		cacheServer := http.Server{
+			Addr:    *cacheBind,
+			Handler: pool,
+		}
+		go func() {
+			log.Printf("Starting up the cache HTTP server on address %s", *cacheBind)
 
-		err := cacheServer.ListenAndServe()
-		if err != nil {
-			log.Fatal(err)
+			err := cacheServer.ListenAndServe()
+			if err != nil {
+				log.Fatal(err)
+			}
+		}()
+	case "grpc":
+		dialOpt := grpc.WithInsecure()
+		if *cacheGRPCTLS {
+			dialOpt = grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{}))
 		}
-	}()
+		grpcPool := NewGRPCPool(*cachePublic, *cacheHashReplicas, dialOpt)
+		grpcPool.Set(strings.Split(*cachePeers, ",")...)
+		peerSetter = grpcPool
 
-	// Create a new groupcache pool
-	cache := groupcache.NewGroup("ritratt", *cacheSize, groupcache.GetterFunc(func(ctx groupcache.Context, url string, dest groupcache.Sink) error {
-		// First try with https
-		schema := "https://"
-		resp, err := http.Head("https://" + url)
+		grpcServer := grpc.NewServer()
+		ritrattpb.RegisterPeerServer(grpcServer, grpcPeerServer{})
+
+		lis, err := net.Listen("tcp", *cacheGRPCBind)
 		if err != nil {
-			log.Printf("[https] Error while querying %s: %s", url, err)
+			log.Fatalf("Error listening on %s: %s", *cacheGRPCBind, err)
+		}
+		go func() {
+			log.Printf("Starting up the cache gRPC server on address %s", *cacheGRPCBind)
 
-			// https doesn't work, try http
-			schema = "http://"
-			resp, err = http.Head("http://" + url)
-			if err != nil {
-				log.Printf("[http] Error while querying %s: %s", url, err)
+			if err := grpcServer.Serve(lis); err != nil {
+				log.Fatal(err)
 			}
-		}
+		}()
+	default:
+		log.Fatalf("Unknown cache_transport: %s", *cacheTransport)
+	}
+
+	// Wire up dynamic peer discovery: whatever backend is selected, its
+	// results are re-applied to the peer transport above on every change
+	var discoverer Discoverer
+	switch *cachePeerDiscovery {
+	case "static":
+		discoverer = staticDiscoverer{peers: strings.Split(*cachePeers, ",")}
+	case "dns":
+		discoverer = dnsDiscoverer{service: *cachePeerDNSService, proto: *cachePeerDNSProto, name: *cachePeerDNSName}
+	case "consul":
+		discoverer = consulDiscoverer{addr: *cachePeerConsulAddr, service: *cachePeerConsulName, client: http.DefaultClient}
+	case "file":
+		discoverer = fileDiscoverer{path: *cachePeerFile}
+	default:
+		log.Fatalf("Unknown cache_peer_discovery: %s", *cachePeerDiscovery)
+	}
+
+	pollInterval, err := time.ParseDuration(*cachePeerPoll)
+	if err != nil {
+		log.Fatalf("Invalid cache_peer_poll: %s", err)
+	}
+	debounce, err := time.ParseDuration(*cachePeerDebounce)
+	if err != nil {
+		log.Fatalf("Invalid cache_peer_debounce: %s", err)
+	}
+
+	watcher := NewWatcher(discoverer, peerSetter, *cacheHashReplicas, pollInterval, debounce)
+	go watcher.Run(nil)
+
+	// Track upstream fetch latency for /metrics
+	metrics := newMetricsRecorder()
+
+	fetchTimeoutDuration, err := time.ParseDuration(*fetchTimeout)
+	if err != nil {
+		log.Fatalf("Invalid fetch_timeout: %s", err)
+	}
+	upstreamClient := newUpstreamClient(fetchTimeoutDuration, *allowPrivateTargets)
+
+	cacheTTLDuration, err := time.ParseDuration(*cacheTTL)
+	if err != nil {
+		log.Fatalf("Invalid cache_ttl: %s", err)
+	}
+	cacheNegativeTTLDuration, err := time.ParseDuration(*cacheNegativeTTL)
+	if err != nil {
+		log.Fatalf("Invalid cache_negative_ttl: %s", err)
+	}
+	freshness := NewFreshness(cacheTTLDuration, cacheNegativeTTLDuration)
 
-		// Content-Type of the result has to start with image/
-		// We also don't support SVGs, check out this link for more information:
-		// https://www.owasp.org/images/0/03/Mario_Heiderich_OWASP_Sweden_The_image_that_called_me.pdf
-		ct := resp.Header.Get("Content-Type")
-		if !strings.HasPrefix(ct, "image/") || strings.Contains(ct, "image/svg+xml") {
-			log.Printf("[head] Invalid Content-Type of %s", url)
-			return ErrInvalidContentType
+	// Create a new groupcache pool
+	cache := groupcache.NewGroup("ritratt", *cacheSize, groupcache.GetterFunc(func(ctx context.Context, key string, dest groupcache.Sink) error {
+		// The key is "{spec}|{url}", spec being "-" when no transformation
+		// was requested; split it back out so variants of the same image
+		// still share the groupcache key namespace
+		spec, url, err := splitCacheKey(key)
+		if err != nil {
+			return err
 		}
 
-		// Query the proper URL, now including the body
-		resp, err = http.Get(schema + url)
-		defer resp.Body.Close()
+		// Conditionally re-validate against whatever we last fetched for
+		// this key, so an unchanged origin costs a 304 instead of a full
+		// re-download
+		prior := freshness.Lookup(key)
+
+		fetchStart := time.Now()
+		env, err := fetchUpstream(ctx, upstreamClient, *maxImageBytes, url, prior)
+		metrics.ObserveFetchDuration(time.Since(fetchStart).Seconds())
 		if err != nil {
-			log.Printf("[get] Error while querying %s: %s", url, err)
-		} else {
-			log.Printf("[get] Loaded %s", url)
+			log.Printf("[fetch] Error while fetching %s: %s", url, err)
+			return err
 		}
 
-		// Content-Type check #2
-		ct = resp.Header.Get("Content-Type")
-		if !strings.HasPrefix(ct, "image/") || strings.Contains(ct, "image/svg+xml") {
-			log.Printf("[get] Invalid Content-Type of %s", url)
-			return ErrInvalidContentType
+		if env.Status == http.StatusOK {
+			// Apply the transformation (if any) encoded into the key, so
+			// that every requested variant is cached as its own entry
+			env.ContentType, env.Body, err = applyTransform(env.ContentType, env.Body, spec)
+			if err != nil {
+				log.Printf("[transform] Error while transforming %s: %s", url, err)
+				return err
+			}
 		}
 
-		// Read the body
-		body, err := ioutil.ReadAll(resp.Body)
+		freshness.Store(key, env)
+
+		raw, err := encodeEnvelope(env)
 		if err != nil {
 			return err
 		}
-
-		// Put the body into cache with the Content-Type
-		dest.SetString(ct + ";" + string(body))
+		dest.SetBytes(raw)
 
 		return nil
 	}))
 
+	adminServer := http.Server{
+		Addr:    *adminBind,
+		Handler: newAdminMux(cache, metrics),
+	}
+	go func() {
+		log.Printf("Starting up the admin HTTP server on address %s", *adminBind)
+
+		err := adminServer.ListenAndServe()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
 	log.Printf("Starting up the proxy HTTP server on address %s", *proxyBind)
 	proxyServer := http.Server{
 		Addr: *proxyBind,
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Peer ring debugging
+			if r.URL.Path == "/debug/peers" {
+				watcher.ServeDebugPeers(w, r)
+				return
+			}
+
 			// Index page
-			if len(r.RequestURI) < 3 || r.RequestURI[:3] != "/i/" {
+			if len(r.URL.Path) < 3 || r.URL.Path[:3] != "/i/" {
 				w.Write([]byte("lavab/ritratt"))
 				return
 			}
 
-			// Get the data from groupcache
-			var data string
-			err := cache.Get(nil, r.RequestURI[3:], groupcache.StringSink(&data))
+			// Parse the transformation spec (path or query form) and the
+			// upstream URL out of the request. The URL must come from
+			// r.URL.Path, not RequestURI, so ritratt's own ?width=/?format=
+			// params aren't leaked to the origin or baked into the cache key.
+			spec, url, err := parseTransformSpec(r.URL.Path[3:], r.URL.Query())
 			if err != nil {
 				w.Write([]byte(err.Error()))
 				return
 			}
 
-			// Split the result into two parts
-			parts := strings.SplitN(data, ";", 2)
-
-			// Set the content type
-			w.Header().Set("Content-Type", parts[0])
+			// Get the envelope from groupcache, propagating the request's
+			// context so the upstream fetch cancels if the client
+			// disconnects, and transparently revalidating it if stale
+			env, err := fetchImage(r.Context(), cache, freshness, spec, url)
+			if err != nil {
+				w.Write([]byte(err.Error()))
+				return
+			}
 
-			// Write the body
-			w.Write([]byte(parts[1]))
+			switch env.Status {
+			case http.StatusOK:
+				if env.ETag != "" {
+					w.Header().Set("ETag", env.ETag)
+				}
+				if env.MaxAge > 0 {
+					w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(env.MaxAge.Seconds())))
+				}
+				w.Header().Set("Content-Type", env.ContentType)
+				w.Write(env.Body)
+			case http.StatusNotFound:
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte("not found"))
+			default:
+				w.WriteHeader(http.StatusBadGateway)
+				w.Write([]byte(ErrInvalidContentType.Error()))
+			}
 		}),
 	}
 	log.Fatal(proxyServer.ListenAndServe())
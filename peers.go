@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/groupcache/v2/consistenthash"
+)
+
+// Discoverer returns the current set of groupcache peer addresses. It is
+// the pluggable half of the peers subsystem: static config, DNS SRV, Consul
+// and a watched file are all expressed as different Discoverers, each
+// polled on the same schedule by a Watcher.
+type Discoverer interface {
+	Discover() ([]string, error)
+}
+
+// PeerSetter is satisfied by groupcache's HTTPPool and by GRPCPool: both
+// expose Set(peers...) to replace the current peer list.
+type PeerSetter interface {
+	Set(peers ...string)
+}
+
+// staticDiscoverer always returns the same, fixed peer list.
+type staticDiscoverer struct {
+	peers []string
+}
+
+func (d staticDiscoverer) Discover() ([]string, error) {
+	return d.peers, nil
+}
+
+// dnsDiscoverer resolves peers from a DNS SRV record.
+type dnsDiscoverer struct {
+	service string
+	proto   string
+	name    string
+}
+
+func (d dnsDiscoverer) Discover() ([]string, error) {
+	_, addrs, err := net.LookupSRV(d.service, d.proto, d.name)
+	if err != nil {
+		return nil, err
+	}
+
+	peers := make([]string, len(addrs))
+	for i, addr := range addrs {
+		peers[i] = fmt.Sprintf("%s:%d", strings.TrimSuffix(addr.Target, "."), addr.Port)
+	}
+
+	return peers, nil
+}
+
+// consulDiscoverer resolves peers from Consul's health-checked service
+// catalog, only considering instances that are currently passing.
+type consulDiscoverer struct {
+	addr    string
+	service string
+	client  *http.Client
+}
+
+func (d consulDiscoverer) Discover() ([]string, error) {
+	resp, err := d.client.Get(fmt.Sprintf("%s/v1/health/service/%s?passing=true", d.addr, d.service))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var entries []struct {
+		Service struct {
+			Address string `json:"Address"`
+			Port    int    `json:"Port"`
+		} `json:"Service"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	peers := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		peers = append(peers, fmt.Sprintf("%s:%d", entry.Service.Address, entry.Service.Port))
+	}
+
+	return peers, nil
+}
+
+// fileDiscoverer reads a newline-separated peer list from disk, re-reading
+// it on every poll so an operator (or a config-management tool) can update
+// membership by rewriting the file.
+type fileDiscoverer struct {
+	path string
+}
+
+func (d fileDiscoverer) Discover() ([]string, error) {
+	data, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var peers []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			peers = append(peers, line)
+		}
+	}
+
+	return peers, nil
+}
+
+// Watcher polls a Discoverer and re-applies the result to a PeerSetter
+// whenever membership changes, debounced so a burst of flapping changes
+// collapses into a single Set call. It also keeps its own consistent-hash
+// ring so /debug/peers can report key ownership independently of whatever
+// hashing the underlying transport does internally.
+type Watcher struct {
+	discoverer Discoverer
+	setter     PeerSetter
+	replicas   int
+	poll       time.Duration
+	debounce   time.Duration
+
+	mu    sync.RWMutex
+	ring  *consistenthash.Map
+	peers []string
+
+	pending      []string
+	pendingSince time.Time
+}
+
+// NewWatcher creates a Watcher. It does not start polling until Run is
+// called.
+func NewWatcher(discoverer Discoverer, setter PeerSetter, replicas int, poll, debounce time.Duration) *Watcher {
+	return &Watcher{
+		discoverer: discoverer,
+		setter:     setter,
+		replicas:   replicas,
+		poll:       poll,
+		debounce:   debounce,
+	}
+}
+
+// Run polls the discoverer every poll interval until stop is closed,
+// applying new peer sets once they've been stable for at least debounce.
+func (w *Watcher) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(w.poll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			w.tick()
+		}
+	}
+}
+
+func (w *Watcher) tick() {
+	peers, err := w.discoverer.Discover()
+	if err != nil {
+		log.Printf("[peers] Error discovering peers: %s", err)
+		return
+	}
+	sort.Strings(peers)
+
+	w.mu.RLock()
+	current := w.peers
+	w.mu.RUnlock()
+
+	if equalStrings(peers, current) {
+		w.pending = nil
+		return
+	}
+
+	if !equalStrings(peers, w.pending) {
+		w.pending = peers
+		w.pendingSince = time.Now()
+		return
+	}
+
+	if time.Since(w.pendingSince) >= w.debounce {
+		w.apply(peers)
+		w.pending = nil
+	}
+}
+
+func (w *Watcher) apply(peers []string) {
+	ring := consistenthash.New(w.replicas, nil)
+	ring.Add(peers...)
+
+	w.mu.Lock()
+	w.peers = peers
+	w.ring = ring
+	w.mu.Unlock()
+
+	log.Printf("[peers] Peer set changed: %v", peers)
+	if len(peers) > 1 {
+		log.Printf("[peers] WARNING: %d peers configured; cache TTL/revalidation (Freshness, see cache.go) is process-local and only behaves correctly with a single peer", len(peers))
+	}
+	w.setter.Set(peers...)
+}
+
+// ServeDebugPeers handles /debug/peers, printing the current ring members
+// and, if a ?keys=a,b,c query param is given, which peer currently owns
+// each of those keys.
+func (w *Watcher) ServeDebugPeers(rw http.ResponseWriter, r *http.Request) {
+	w.mu.RLock()
+	peers := append([]string(nil), w.peers...)
+	ring := w.ring
+	w.mu.RUnlock()
+
+	out := struct {
+		Peers  []string          `json:"peers"`
+		Owners map[string]string `json:"owners,omitempty"`
+	}{
+		Peers: peers,
+	}
+
+	if keys := r.URL.Query().Get("keys"); keys != "" && ring != nil {
+		out.Owners = make(map[string]string)
+		for _, key := range strings.Split(keys, ",") {
+			out.Owners[key] = ring.Get(key)
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(out)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
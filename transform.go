@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/gift"
+	"golang.org/x/image/webp"
+)
+
+// transformSpec describes the requested variant of an image: its target
+// dimensions, how it should be fit into them, and the output format. The
+// zero value means "no transformation, keep the original bytes/format".
+// Format accepts "jpeg"/"jpg", "png" and "gif"; "webp" is rejected by
+// encodeImage since there's no WebP encoder wired in, only a decoder.
+type transformSpec struct {
+	Width  int
+	Height int
+	Fit    string
+	Format string
+}
+
+// String renders the spec into a canonical form used as part of the
+// groupcache key, so that the same variant requested via the path or via
+// query params always maps to the same cache entry.
+func (s transformSpec) String() string {
+	if s.isZero() {
+		return "-"
+	}
+	return fmt.Sprintf("%dx%d/%s/%s", s.Width, s.Height, s.Fit, s.Format)
+}
+
+func (s transformSpec) isZero() bool {
+	return s.Width == 0 && s.Height == 0 && s.Fit == "" && s.Format == ""
+}
+
+// parseTransformSpec extracts a transformSpec from either the request path
+// (/i/{w}x{h}/{fit}/{format}/{url}) or query parameters
+// (?width=&height=&fit=&format=), returning the remaining upstream URL.
+func parseTransformSpec(uri string, query map[string][]string) (transformSpec, string, error) {
+	var spec transformSpec
+
+	if q := first(query, "width"); q != "" {
+		w, err := strconv.Atoi(q)
+		if err != nil {
+			return spec, "", fmt.Errorf("invalid width: %s", q)
+		}
+		spec.Width = w
+	}
+	if q := first(query, "height"); q != "" {
+		h, err := strconv.Atoi(q)
+		if err != nil {
+			return spec, "", fmt.Errorf("invalid height: %s", q)
+		}
+		spec.Height = h
+	}
+	spec.Fit = first(query, "fit")
+	spec.Format = first(query, "format")
+	if !spec.isZero() {
+		return spec, uri, nil
+	}
+
+	// Path form: {w}x{h}/{fit}/{format}/{url}
+	parts := strings.SplitN(uri, "/", 4)
+	if len(parts) == 4 {
+		var w, h int
+		if n, _ := fmt.Sscanf(parts[0], "%dx%d", &w, &h); n == 2 {
+			spec.Width = w
+			spec.Height = h
+			spec.Fit = parts[1]
+			spec.Format = parts[2]
+			return spec, parts[3], nil
+		}
+	}
+
+	return spec, uri, nil
+}
+
+// buildCacheKey joins a transformSpec and an upstream URL into the single
+// string groupcache uses as its key, so that two requests for the same
+// variant of the same image always land on the same cache entry.
+func buildCacheKey(spec transformSpec, url string) string {
+	return spec.String() + "|" + url
+}
+
+// splitCacheKey reverses buildCacheKey.
+func splitCacheKey(key string) (transformSpec, string, error) {
+	parts := strings.SplitN(key, "|", 2)
+	if len(parts) != 2 {
+		return transformSpec{}, "", fmt.Errorf("malformed cache key: %s", key)
+	}
+
+	if parts[0] == "-" {
+		return transformSpec{}, parts[1], nil
+	}
+
+	var spec transformSpec
+	segs := strings.SplitN(parts[0], "/", 3)
+	if len(segs) != 3 {
+		return transformSpec{}, "", fmt.Errorf("malformed cache key: %s", key)
+	}
+	if _, err := fmt.Sscanf(segs[0], "%dx%d", &spec.Width, &spec.Height); err != nil {
+		return transformSpec{}, "", fmt.Errorf("malformed cache key: %s", key)
+	}
+	spec.Fit = segs[1]
+	spec.Format = segs[2]
+
+	return spec, parts[1], nil
+}
+
+func first(query map[string][]string, key string) string {
+	if v, ok := query[key]; ok && len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// applyTransform decodes body as an image, resizes/crops it per spec and
+// re-encodes it in the requested format, returning the new Content-Type and
+// bytes. If spec is the zero value, body is returned unmodified.
+func applyTransform(contentType string, body []byte, spec transformSpec) (string, []byte, error) {
+	if spec.isZero() {
+		return contentType, body, nil
+	}
+
+	img, srcFormat, err := decodeImage(contentType, body)
+	if err != nil {
+		return "", nil, err
+	}
+
+	filters := []gift.Filter{}
+	if spec.Width > 0 || spec.Height > 0 {
+		resampling := gift.ResizeFilter(gift.CubicFilter)
+		switch spec.Fit {
+		case "cover":
+			filters = append(filters, gift.ResizeToFill(spec.Width, spec.Height, resampling, gift.CenterAnchor))
+		case "contain", "":
+			filters = append(filters, gift.ResizeToFit(spec.Width, spec.Height, resampling))
+		default:
+			return "", nil, fmt.Errorf("unknown fit mode: %s", spec.Fit)
+		}
+	}
+
+	g := gift.New(filters...)
+	dst := image.NewRGBA(g.Bounds(img.Bounds()))
+	g.Draw(dst, img)
+
+	// An unspecified Format means "keep whatever the source was", not "give
+	// me a PNG" - only an explicit format=png should change the encoding.
+	format := spec.Format
+	if format == "" {
+		format = srcFormat
+	}
+
+	return encodeImage(dst, format)
+}
+
+func decodeImage(contentType string, body []byte) (image.Image, string, error) {
+	r := bytes.NewReader(body)
+	switch contentType {
+	case "image/jpeg":
+		img, err := jpeg.Decode(r)
+		return img, "jpeg", err
+	case "image/png":
+		img, err := png.Decode(r)
+		return img, "png", err
+	case "image/gif":
+		img, err := gif.Decode(r)
+		return img, "gif", err
+	case "image/webp":
+		img, err := webp.Decode(r)
+		return img, "webp", err
+	default:
+		img, format, err := image.Decode(r)
+		return img, format, err
+	}
+}
+
+func encodeImage(img image.Image, format string) (string, []byte, error) {
+	var buf bytes.Buffer
+
+	switch format {
+	case "jpeg", "jpg":
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85}); err != nil {
+			return "", nil, err
+		}
+		return "image/jpeg", buf.Bytes(), nil
+	case "png":
+		if err := png.Encode(&buf, img); err != nil {
+			return "", nil, err
+		}
+		return "image/png", buf.Bytes(), nil
+	case "gif":
+		if err := gif.Encode(&buf, img, nil); err != nil {
+			return "", nil, err
+		}
+		return "image/gif", buf.Bytes(), nil
+	case "webp":
+		// golang.org/x/image/webp only decodes; there's no encoder in the
+		// standard toolchain, so honor the request honestly instead of
+		// silently substituting a different format.
+		return "", nil, fmt.Errorf("unsupported output format: webp (encoding not implemented)")
+	default:
+		return "", nil, fmt.Errorf("unsupported output format: %q", format)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestCacheKeyRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		spec transformSpec
+		url  string
+	}{
+		{"zero spec", transformSpec{}, "example.com/a.jpg"},
+		{"resize only", transformSpec{Width: 100, Height: 200, Fit: "cover", Format: "jpeg"}, "example.com/b.png"},
+		{"empty format", transformSpec{Width: 50, Height: 50, Fit: "contain", Format: ""}, "example.com/c.gif"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := buildCacheKey(tt.spec, tt.url)
+
+			gotSpec, gotURL, err := splitCacheKey(key)
+			if err != nil {
+				t.Fatalf("splitCacheKey(%q) returned error: %s", key, err)
+			}
+			if gotSpec != tt.spec {
+				t.Errorf("splitCacheKey(%q) spec = %+v, want %+v", key, gotSpec, tt.spec)
+			}
+			if gotURL != tt.url {
+				t.Errorf("splitCacheKey(%q) url = %q, want %q", key, gotURL, tt.url)
+			}
+		})
+	}
+}
+
+func TestSplitCacheKeyMalformed(t *testing.T) {
+	tests := []string{
+		"",
+		"no-pipe-separator",
+		"1x2/cover|example.com/a.jpg",
+		"axb/cover/jpeg|example.com/a.jpg",
+	}
+
+	for _, key := range tests {
+		t.Run(key, func(t *testing.T) {
+			if _, _, err := splitCacheKey(key); err == nil {
+				t.Errorf("splitCacheKey(%q) expected an error, got nil", key)
+			}
+		})
+	}
+}